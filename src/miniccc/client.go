@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand"
 	log "minilog"
 	"net"
 	"os"
-	"os/exec"
 	"runtime"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 )
@@ -22,6 +19,7 @@ type Client struct {
 	OS        string
 	IP        []string
 	MAC       []string
+	Tags      map[string]string
 	Checkin   time.Time
 	Responses []*Response
 }
@@ -45,14 +43,26 @@ func clientSetup() {
 	r := rand.New(s)
 	CID = r.Int63()
 
+	if configuredServer != "" {
+		setServerAddr(configuredServer)
+	} else {
+		log.Debugln("no -server given, discovering one")
+		go clientDiscover(ronNamespace, ronDiscoveryGroup)
+	}
+
+	if err := clientTLSSetup(); err != nil {
+		log.Error("tls setup: %v", err)
+	}
+
 	go clientCommandProcessor()
+	go clientHeartbeatLoop()
 
 	log.Debug("CID: %v", CID)
 }
 
-func clientHeartbeat() *hb {
-	log.Debugln("clientHeartbeat")
-
+// localClient describes this node, for heartbeats and for matching
+// command filters.
+func localClient() *Client {
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatalln(err)
@@ -63,14 +73,9 @@ func clientHeartbeat() *hb {
 		Arch:     runtime.GOARCH,
 		OS:       runtime.GOOS,
 		Hostname: hostname,
+		Tags:     clientTags,
 	}
 
-	// attach any command responses and clear the response queue
-	responseQueueLock.Lock()
-	c.Responses = responseQueue
-	responseQueue = []*Response{}
-	responseQueueLock.Unlock()
-
 	// process network info
 	ints, err := net.Interfaces()
 	if err != nil {
@@ -93,6 +98,27 @@ func clientHeartbeat() *hb {
 		}
 	}
 
+	return c
+}
+
+func clientHeartbeat() *hb {
+	log.Debugln("clientHeartbeat")
+
+	if !serverIsKnown() {
+		// still discovering, nothing to heartbeat to yet -- leave
+		// responseQueue alone so nothing is lost once we find one
+		log.Debugln("no server known, skipping heartbeat")
+		return nil
+	}
+
+	c := localClient()
+
+	// attach any command responses and clear the response queue
+	responseQueueLock.Lock()
+	c.Responses = responseQueue
+	responseQueue = []*Response{}
+	responseQueueLock.Unlock()
+
 	me := make(map[int64]*Client)
 	me[CID] = c
 	h := &hb{
@@ -100,6 +126,16 @@ func clientHeartbeat() *hb {
 		Clients:      me,
 		MaxCommandID: getMaxCommandID(),
 	}
+
+	if tlsKeyPath != "" && !clientHasCert() {
+		// not pinned yet, attach a CSR so the server can sign one
+		if csr, err := clientCSR(); err != nil {
+			log.Error("generating CSR: %v", err)
+		} else {
+			h.CSR = csr
+		}
+	}
+
 	log.Debug("client heartbeat %v", h)
 	return h
 }
@@ -116,11 +152,19 @@ func clientCommands(newCommands map[int]*Command) {
 
 	var myCommands []*Command
 
+	me := localClient()
 	maxCommandID := getMaxCommandID()
-	for _, c := range ids {
-		// TODO: allow filters here
-		if newCommands[c].ID > maxCommandID {
-			myCommands = append(myCommands, newCommands[c])
+	for _, id := range ids {
+		c := newCommands[id]
+		if c.ID <= maxCommandID {
+			continue
+		}
+
+		if matchFilter(c.Filter, me) {
+			myCommands = append(myCommands, c)
+		} else {
+			// doesn't apply to us, but don't reconsider it either
+			checkMaxCommandID(c.ID)
 		}
 	}
 
@@ -135,11 +179,32 @@ func clientCommandProcessor() {
 			log.Debug("processing command %v", v.ID)
 			switch v.Type {
 			case COMMAND_EXEC:
-				clientCommandExec(v)
+				// runs on its own goroutine (bounded by execSem) so a
+				// hung or long-running command can't starve the rest
+				// of the queue -- the semaphore is acquired inside the
+				// goroutine, not here, so acquiring it never blocks
+				// this shared dispatch loop
+				v := v
+				go func() {
+					execSem <- struct{}{}
+					defer func() { <-execSem }()
+					clientCommandExec(v)
+				}()
 			case COMMAND_FILE_SEND:
+				clientCommandFileSend(v)
 			case COMMAND_FILE_RECV:
+				clientCommandFileRecv(v)
 			case COMMAND_LOG:
 				clientCommandLog(v)
+			case COMMAND_KILL:
+				clientCommandKill(v)
+			case COMMAND_TUNNEL:
+				// called inline so a stream's commands reach its
+				// worker in order; the dial and writes run on the
+				// per-stream worker goroutine, see tunnel.go
+				clientCommandTunnel(v)
+			case COMMAND_TUNNEL_CLOSE:
+				clientCommandTunnelClose(v)
 			default:
 				log.Error("invalid command type %v", v.Type)
 			}
@@ -173,38 +238,3 @@ func clientCommandLog(c *Command) {
 
 	queueResponse(resp)
 }
-
-func clientCommandExec(c *Command) {
-	log.Debug("clientCommandExec %v", c.ID)
-	resp := &Response{
-		ID: c.ID,
-	}
-
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
-	path, err := exec.LookPath(c.Command[0])
-	if err != nil {
-		log.Errorln(err)
-		resp.Stderr = err.Error()
-	} else {
-		cmd := &exec.Cmd{
-			Path:   path,
-			Args:   c.Command,
-			Env:    nil,
-			Dir:    "",
-			Stdout: &stdout,
-			Stderr: &stderr,
-		}
-		log.Debug("executing %v", strings.Join(c.Command, " "))
-		err := cmd.Run()
-		if err != nil {
-			log.Errorln(err)
-			return
-		}
-		resp.Stdout = stdout.String()
-		resp.Stderr = stderr.String()
-	}
-
-	queueResponse(resp)
-}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	log "minilog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	discoveryPort = 8966
+
+	// SOLICIT_LIMIT is how many solicits we send at the base rate before
+	// backing off; SOLICIT_RATIO is the multiplier applied after that, up
+	// to solicitCeiling, so a fleet coming up simultaneously doesn't flood
+	// the server.
+	SOLICIT_LIMIT = 10
+	SOLICIT_RATIO = 2
+
+	solicitBase    = 5 * time.Second
+	solicitCeiling = 5 * time.Minute
+
+	heartbeatRate = 5 * time.Second
+)
+
+var (
+	serverAddr     string
+	serverAddrLock sync.Mutex
+
+	discoveryNamespace string
+
+	// configuredServer is set from the -server flag; when empty the
+	// client falls back to UDP discovery instead.
+	configuredServer  string
+	ronNamespace      = "minimega"
+	ronDiscoveryGroup = "255.255.255.255:8966"
+)
+
+func serverIsKnown() bool {
+	serverAddrLock.Lock()
+	defer serverAddrLock.Unlock()
+	return serverAddr != ""
+}
+
+func getServerAddr() string {
+	serverAddrLock.Lock()
+	defer serverAddrLock.Unlock()
+	return serverAddr
+}
+
+// clientServerLost forgets the current server address, forcing
+// rediscovery. The caller is whatever owns the transport, once it notices
+// the connection is gone.
+func clientServerLost() {
+	serverAddrLock.Lock()
+	defer serverAddrLock.Unlock()
+	serverAddr = ""
+}
+
+func setServerAddr(addr string) {
+	serverAddrLock.Lock()
+	defer serverAddrLock.Unlock()
+	if serverAddr != addr {
+		log.Info("discovered ron server at %v", addr)
+	}
+	serverAddr = addr
+}
+
+// clientDiscover solicits for a ron server on group, a UDP broadcast or
+// multicast address, until one responds, then keeps listening so we
+// notice if the server changes or disappears. namespace scopes solicits
+// and replies so multiple ron deployments can share an L2 segment without
+// cross-talk.
+func clientDiscover(namespace, group string) {
+	discoveryNamespace = namespace
+
+	// net.ListenPacket doesn't set SO_BROADCAST, so without this a write
+	// to a broadcast address (the default ronDiscoveryGroup) fails with
+	// "permission denied" -- only multicast groups would work otherwise.
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%v", discoveryPort))
+	if err != nil {
+		log.Error("discovery listen: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	go clientDiscoverListen(conn)
+
+	solicits := 0
+	for {
+		if !serverIsKnown() {
+			if err := clientSolicit(conn, namespace, group); err != nil {
+				log.Error("discovery solicit: %v", err)
+			}
+			solicits++
+		} else {
+			solicits = 0
+		}
+
+		wait := solicitBase
+		for i := SOLICIT_LIMIT; i < solicits && wait < solicitCeiling; i++ {
+			wait *= SOLICIT_RATIO
+		}
+		if wait > solicitCeiling {
+			wait = solicitCeiling
+		}
+		time.Sleep(wait)
+	}
+}
+
+func clientSolicit(conn net.PacketConn, namespace, group string) error {
+	dst, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	msg := fmt.Sprintf("ron:%v:%v:%v", namespace, hostname, CID)
+	_, err = conn.WriteTo([]byte(msg), dst)
+	return err
+}
+
+// clientHeartbeatLoop builds and sends a heartbeat every heartbeatRate. A
+// send failure forgets the server (clientServerLost) so clientDiscover
+// resolicits instead of spinning forever against a dead address --
+// responses the failed heartbeat carried go back on the front of
+// responseQueue, so none are lost. Clients started with
+// -server never run clientDiscover, so losing the server there would mean
+// going silent forever; for them, losing the server just means falling
+// back to retrying configuredServer directly.
+func clientHeartbeatLoop() {
+	for {
+		time.Sleep(heartbeatRate)
+
+		h := clientHeartbeat()
+		if h == nil {
+			continue
+		}
+
+		if err := sendHeartbeat(h); err != nil {
+			log.Error("heartbeat to %v: %v", getServerAddr(), err)
+			responseQueueLock.Lock()
+			responseQueue = append(h.Clients[CID].Responses, responseQueue...)
+			responseQueueLock.Unlock()
+			clientServerLost()
+			if configuredServer != "" {
+				setServerAddr(configuredServer)
+			}
+		}
+	}
+}
+
+func sendHeartbeat(h *hb) error {
+	var conn net.Conn
+	var err error
+	if tlsKeyPath != "" {
+		conf, confErr := clientTLSConfig()
+		if confErr != nil {
+			return confErr
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: heartbeatRate}, "tcp", getServerAddr(), conf)
+	} else {
+		conn, err = net.DialTimeout("tcp", getServerAddr(), heartbeatRate)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return gob.NewEncoder(conn).Encode(h)
+}
+
+// clientDiscoverListen waits for a server's reply, "ron:<namespace>:<tcp
+// addr>", and records its TCP endpoint.
+func clientDiscoverListen(conn net.PacketConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Error("discovery read: %v", err)
+			return
+		}
+
+		fields := strings.SplitN(string(buf[:n]), ":", 3)
+		if len(fields) != 3 || fields[0] != "ron" || fields[1] != discoveryNamespace {
+			continue
+		}
+
+		setServerAddr(fields[2])
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	log "minilog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxConcurrentExec bounds how many COMMAND_EXEC commands can run at once,
+// so a pile of long-running or hung commands can't exhaust resources.
+const maxConcurrentExec = 16
+
+var execSem = make(chan struct{}, maxConcurrentExec)
+
+var (
+	execInFlight     = make(map[int]context.CancelFunc)
+	execInFlightLock sync.Mutex
+)
+
+const execFlushInterval = 500 * time.Millisecond
+
+// clientCommandExec runs c.Command, streaming partial stdout/stderr back as
+// incremental Responses (tagged with a Seq number) every execFlushInterval,
+// and a last Response with Final set and the process's exit code. If
+// c.Timeout is set the command is killed after that long; it can also be
+// killed early by a matching COMMAND_KILL.
+func clientCommandExec(c *Command) {
+	log.Debug("clientCommandExec %v", c.ID)
+
+	path, err := exec.LookPath(c.Command[0])
+	if err != nil {
+		log.Errorln(err)
+		queueResponse(&Response{ID: c.ID, Stderr: err.Error(), Final: true})
+		return
+	}
+
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	execInFlightLock.Lock()
+	execInFlight[c.ID] = cancel
+	execInFlightLock.Unlock()
+	defer func() {
+		execInFlightLock.Lock()
+		delete(execInFlight, c.ID)
+		execInFlightLock.Unlock()
+	}()
+
+	cmd := exec.CommandContext(ctx, path, c.Command[1:]...)
+	log.Debug("executing %v", strings.Join(c.Command, " "))
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		queueResponse(&Response{ID: c.ID, Stderr: err.Error(), Final: true})
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		queueResponse(&Response{ID: c.ID, Stderr: err.Error(), Final: true})
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		queueResponse(&Response{ID: c.ID, Stderr: err.Error(), Final: true})
+		return
+	}
+
+	var mu sync.Mutex
+	var outBuf, errBuf bytes.Buffer
+	var seq int
+
+	flush := func(final bool, exitCode int) {
+		mu.Lock()
+		out, errs := outBuf.String(), errBuf.String()
+		outBuf.Reset()
+		errBuf.Reset()
+		if out == "" && errs == "" && !final {
+			mu.Unlock()
+			return
+		}
+		seq++
+		resp := &Response{
+			ID:     c.ID,
+			Seq:    seq,
+			Stdout: out,
+			Stderr: errs,
+		}
+		mu.Unlock()
+
+		if final {
+			resp.Final = true
+			resp.ExitCode = exitCode
+		}
+		queueResponse(resp)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() { defer readers.Done(); streamOutput(stdout, &mu, &outBuf) }()
+	go func() { defer readers.Done(); streamOutput(stderr, &mu, &errBuf) }()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(execFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush(false, 0)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// StdoutPipe/StderrPipe's docs: it's incorrect to call Wait before all
+	// reads from the pipes have completed, so join the readers first.
+	readers.Wait()
+	waitErr := cmd.Wait()
+	close(done)
+
+	exitCode := 0
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		mu.Lock()
+		errBuf.WriteString(fmt.Sprintf("command timed out after %v\n", c.Timeout))
+		mu.Unlock()
+		exitCode = -1
+	case ctx.Err() == context.Canceled:
+		mu.Lock()
+		errBuf.WriteString("command killed\n")
+		mu.Unlock()
+		exitCode = -1
+	case waitErr != nil:
+		if exitErr, ok := waitErr.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else {
+			exitCode = -1
+		}
+	}
+
+	flush(true, exitCode)
+}
+
+func streamOutput(r io.Reader, mu *sync.Mutex, buf *bytes.Buffer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		mu.Lock()
+		buf.WriteString(scanner.Text())
+		buf.WriteString("\n")
+		mu.Unlock()
+	}
+}
+
+// clientCommandKill cancels an in-flight COMMAND_EXEC identified by
+// c.KillID.
+func clientCommandKill(c *Command) {
+	log.Debug("clientCommandKill %v", c.KillID)
+	resp := &Response{ID: c.ID}
+
+	execInFlightLock.Lock()
+	cancel, ok := execInFlight[c.KillID]
+	execInFlightLock.Unlock()
+
+	if !ok {
+		resp.Stderr = fmt.Sprintf("no in-flight command %v", c.KillID)
+	} else {
+		cancel()
+		resp.Stdout = fmt.Sprintf("killed command %v", c.KillID)
+	}
+
+	queueResponse(resp)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "minilog"
+	"os"
+)
+
+const fileChunkSize = 1 << 20 // 1 MiB
+
+// chunkState tracks how much of a file transfer we've already committed to
+// disk, so a dropped connection can resume instead of restarting from
+// scratch. It's persisted next to the destination file as <dest>.ronstate.
+type chunkState struct {
+	Offset  int64
+	Digests []uint64
+}
+
+func sidecarPath(dest string) string {
+	return dest + ".ronstate"
+}
+
+func loadChunkState(dest string) *chunkState {
+	f, err := os.Open(sidecarPath(dest))
+	if err != nil {
+		return &chunkState{}
+	}
+	defer f.Close()
+
+	st := &chunkState{}
+	if err := json.NewDecoder(f).Decode(st); err != nil {
+		log.Error("corrupt chunk state for %v: %v", dest, err)
+		return &chunkState{}
+	}
+	return st
+}
+
+func saveChunkState(dest string, st *chunkState) error {
+	f, err := os.Create(sidecarPath(dest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(st)
+}
+
+func clearChunkState(dest string) {
+	os.Remove(sidecarPath(dest))
+}
+
+// clientCommandFileSend handles one chunk of a file being pushed to us by
+// the server. Chunks may be retransmitted across reconnects, so we track
+// the offset and per-chunk digests we've already committed in a sidecar
+// file and skip anything we've already written.
+func clientCommandFileSend(c *Command) {
+	log.Debug("clientCommandFileSend %v chunk %v", c.ID, c.ChunkIndex)
+	resp := &Response{ID: c.ID}
+
+	if xxhash64(c.FileData) != c.ChunkDigest {
+		resp.Stderr = fmt.Sprintf("chunk %v of %v failed integrity check", c.ChunkIndex, c.FileDest)
+		queueResponse(resp)
+		return
+	}
+
+	st := loadChunkState(c.FileDest)
+
+	if int64(c.ChunkIndex)*fileChunkSize < st.Offset {
+		// already have this chunk. If it's not the final one, that's all
+		// there is to do; if it is, the server still needs the
+		// verify/rename/ack-as-done treatment, since it may have resent
+		// the final chunk precisely because it never saw that happen.
+		if !c.Final {
+			resp.Stdout = fmt.Sprintf("chunk %v of %v already received", c.ChunkIndex, c.FileDest)
+			queueResponse(resp)
+			return
+		}
+		finalizeFileSend(c, resp)
+		return
+	}
+
+	f, err := os.OpenFile(c.FileDest+".part", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		resp.Stderr = err.Error()
+		queueResponse(resp)
+		return
+	}
+	_, err = f.WriteAt(c.FileData, st.Offset)
+	f.Close()
+	if err != nil {
+		resp.Stderr = err.Error()
+		queueResponse(resp)
+		return
+	}
+
+	st.Offset += int64(len(c.FileData))
+	st.Digests = append(st.Digests, c.ChunkDigest)
+
+	if !c.Final {
+		if err := saveChunkState(c.FileDest, st); err != nil {
+			log.Error("saving chunk state for %v: %v", c.FileDest, err)
+		}
+		resp.Stdout = fmt.Sprintf("chunk %v of %v received, offset %v", c.ChunkIndex, c.FileDest, st.Offset)
+		queueResponse(resp)
+		return
+	}
+
+	finalizeFileSend(c, resp)
+}
+
+// finalizeFileSend verifies the assembled .part file against the
+// whole-file digest, renames it into place, clears the sidecar, and acks
+// completion. Called once the final chunk has been written -- or, if it
+// was retransmitted after we'd already written it, without writing
+// anything again.
+func finalizeFileSend(c *Command, resp *Response) {
+	data, err := os.ReadFile(c.FileDest + ".part")
+	if err != nil {
+		if os.IsNotExist(err) {
+			if _, statErr := os.Stat(c.FileDest); statErr == nil {
+				// already finalized by an earlier delivery of this same
+				// final chunk; nothing left to do but ack it again
+				resp.Stdout = fmt.Sprintf("file %v received and verified", c.FileDest)
+				queueResponse(resp)
+				return
+			}
+		}
+		resp.Stderr = err.Error()
+		queueResponse(resp)
+		return
+	}
+	if xxhash64(data) != c.FileDigest {
+		resp.Stderr = fmt.Sprintf("file %v failed whole-file integrity check", c.FileDest)
+		queueResponse(resp)
+		return
+	}
+	if err := os.Rename(c.FileDest+".part", c.FileDest); err != nil {
+		resp.Stderr = err.Error()
+		queueResponse(resp)
+		return
+	}
+
+	clearChunkState(c.FileDest)
+	resp.Stdout = fmt.Sprintf("file %v received and verified", c.FileDest)
+	queueResponse(resp)
+}
+
+// clientCommandFileRecv streams a local file back to the server in
+// fixed-size chunks, one Response per chunk, so a large file doesn't
+// inflate a single heartbeat. c.ResumeOffset and c.ResumeDigests let the
+// server report what it already has, so we only (re-)send what's missing.
+func clientCommandFileRecv(c *Command) {
+	log.Debug("clientCommandFileRecv %v", c.FilePath)
+
+	data, err := os.ReadFile(c.FilePath)
+	if err != nil {
+		queueResponse(&Response{ID: c.ID, Stderr: err.Error()})
+		return
+	}
+
+	fileDigest := xxhash64(data)
+
+	offset := c.ResumeOffset
+	index := int(offset / fileChunkSize)
+	sentFinal := false
+
+	for offset < int64(len(data)) {
+		end := offset + fileChunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		chunk := data[offset:end]
+		digest := xxhash64(chunk)
+		final := end == int64(len(data))
+
+		if index < len(c.ResumeDigests) && c.ResumeDigests[index] == digest {
+			// server already has this chunk, don't resend it, but the
+			// server still needs to hear about the last one so it knows
+			// the transfer is done
+			if final {
+				queueResponse(&Response{ID: c.ID, FilePath: c.FilePath, FileDigest: fileDigest, Final: true})
+				sentFinal = true
+			}
+			offset = end
+			index++
+			continue
+		}
+
+		queueResponse(&Response{
+			ID:          c.ID,
+			FilePath:    c.FilePath,
+			ChunkIndex:  index,
+			ChunkOffset: offset,
+			Data:        chunk,
+			ChunkDigest: digest,
+			FileDigest:  fileDigest,
+			Final:       final,
+		})
+		sentFinal = true
+
+		offset = end
+		index++
+	}
+
+	if !sentFinal {
+		// nothing left to (re)send at all -- e.g. an empty file, or a
+		// resume where the server already has every byte -- but the
+		// server still needs to be told the transfer is complete
+		queueResponse(&Response{ID: c.ID, FilePath: c.FilePath, FileDigest: fileDigest, Final: true})
+	}
+}
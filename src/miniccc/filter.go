@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Filter narrows a Command to a subset of clients. Any field left at its
+// zero value is not evaluated, so an empty Filter (or a nil one) matches
+// everyone.
+type Filter struct {
+	Hostname string // glob, matched against Client.Hostname
+	Arch     string
+	OS       string
+	IP       string // CIDR, matched against Client.IP
+	MAC      string // prefix (OUI), matched against Client.MAC
+	Tags     map[string]string
+}
+
+var clientTags = make(map[string]string)
+
+func clientSetTag(k, v string) {
+	clientTags[k] = v
+}
+
+// matchFilter reports whether c satisfies every field set on f.
+func matchFilter(f *Filter, c *Client) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Hostname != "" {
+		ok, err := filepath.Match(f.Hostname, c.Hostname)
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if f.Arch != "" && f.Arch != c.Arch {
+		return false
+	}
+
+	if f.OS != "" && f.OS != c.OS {
+		return false
+	}
+
+	if f.IP != "" && !matchFilterIP(f.IP, c.IP) {
+		return false
+	}
+
+	if f.MAC != "" && !matchFilterMAC(f.MAC, c.MAC) {
+		return false
+	}
+
+	for k, v := range f.Tags {
+		if c.Tags[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchFilterIP(cidr string, ips []string) bool {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range ips {
+		var ip net.IP
+		if host, _, err := net.ParseCIDR(s); err == nil {
+			ip = host
+		} else {
+			ip = net.ParseIP(s)
+		}
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchFilterMAC(prefix string, macs []string) bool {
+	prefix = strings.ToLower(prefix)
+	for _, mac := range macs {
+		if strings.HasPrefix(strings.ToLower(mac), prefix) {
+			return true
+		}
+	}
+	return false
+}
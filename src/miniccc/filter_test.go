@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestMatchFilter(t *testing.T) {
+	c := &Client{
+		Hostname: "web-03.example.com",
+		Arch:     "amd64",
+		OS:       "linux",
+		IP:       []string{"10.0.0.5/24", "fe80::1/64"},
+		MAC:      []string{"AA:BB:CC:00:11:22"},
+		Tags:     map[string]string{"env": "prod"},
+	}
+
+	cases := []struct {
+		name string
+		f    *Filter
+		want bool
+	}{
+		{"nil filter matches everyone", nil, true},
+		{"empty filter matches everyone", &Filter{}, true},
+
+		{"hostname glob match", &Filter{Hostname: "web-*.example.com"}, true},
+		{"hostname glob mismatch", &Filter{Hostname: "db-*.example.com"}, false},
+
+		{"arch match", &Filter{Arch: "amd64"}, true},
+		{"arch mismatch", &Filter{Arch: "arm64"}, false},
+
+		{"os match", &Filter{OS: "linux"}, true},
+		{"os mismatch", &Filter{OS: "windows"}, false},
+
+		{"ip cidr match", &Filter{IP: "10.0.0.0/24"}, true},
+		{"ip cidr mismatch", &Filter{IP: "192.168.0.0/24"}, false},
+		{"ip malformed cidr never matches", &Filter{IP: "not-a-cidr"}, false},
+
+		{"mac prefix match case-insensitive", &Filter{MAC: "aa:bb:cc"}, true},
+		{"mac prefix mismatch", &Filter{MAC: "de:ad:be"}, false},
+
+		{"tag match", &Filter{Tags: map[string]string{"env": "prod"}}, true},
+		{"tag mismatch", &Filter{Tags: map[string]string{"env": "dev"}}, false},
+		{"tag missing on client", &Filter{Tags: map[string]string{"rack": "a1"}}, false},
+	}
+
+	for _, tc := range cases {
+		if got := matchFilter(tc.f, c); got != tc.want {
+			t.Errorf("%v: matchFilter() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMatchFilterIP(t *testing.T) {
+	cases := []struct {
+		name string
+		cidr string
+		ips  []string
+		want bool
+	}{
+		{"bare ip inside cidr", "10.0.0.0/24", []string{"10.0.0.5"}, true},
+		{"interface-form ip inside cidr", "10.0.0.0/24", []string{"10.0.0.5/24"}, true},
+		{"ip outside cidr", "10.0.0.0/24", []string{"10.0.1.5"}, false},
+		{"ipv6 literal inside cidr", "fe80::/64", []string{"fe80::1"}, true},
+		{"ipv6 interface-form inside cidr", "fe80::/64", []string{"fe80::1/64"}, true},
+		{"malformed cidr", "nope", []string{"10.0.0.5"}, false},
+		{"unparseable address skipped", "10.0.0.0/24", []string{"garbage", "10.0.0.5"}, true},
+		{"no addresses", "10.0.0.0/24", nil, false},
+	}
+
+	for _, tc := range cases {
+		if got := matchFilterIP(tc.cidr, tc.ips); got != tc.want {
+			t.Errorf("%v: matchFilterIP(%q, %v) = %v, want %v", tc.name, tc.cidr, tc.ips, got, tc.want)
+		}
+	}
+}
+
+func TestMatchFilterMAC(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+		macs   []string
+		want   bool
+	}{
+		{"exact oui match", "aa:bb:cc", []string{"aa:bb:cc:00:11:22"}, true},
+		{"case-insensitive match", "AA:BB:CC", []string{"aa:bb:cc:00:11:22"}, true},
+		{"mixed-case prefix against mixed-case mac", "Aa:Bb:Cc", []string{"aA:bB:cC:00:11:22"}, true},
+		{"no match", "de:ad:be", []string{"aa:bb:cc:00:11:22"}, false},
+		{"no addresses", "aa:bb:cc", nil, false},
+	}
+
+	for _, tc := range cases {
+		if got := matchFilterMAC(tc.prefix, tc.macs); got != tc.want {
+			t.Errorf("%v: matchFilterMAC(%q, %v) = %v, want %v", tc.name, tc.prefix, tc.macs, got, tc.want)
+		}
+	}
+}
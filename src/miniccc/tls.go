@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	log "minilog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// -tls-ca, -tls-cert, -tls-key: when tlsKeyPath is set the client uses
+// mutual TLS instead of a plain gob stream for the ron connection.
+var (
+	tlsCAPath   string
+	tlsCertPath string
+	tlsKeyPath  string
+
+	tlsKey  *ecdsa.PrivateKey
+	tlsCert []byte // PEM, signed by the server once our CSR is pinned
+	tlsLock sync.Mutex
+)
+
+// clientTLSSetup loads a persisted client identity from tlsKeyPath and
+// tlsCertPath, generating a fresh keypair if none is on disk yet, so
+// restarts keep the same identity. The signed cert may not exist yet; in
+// that case clientHeartbeat attaches a CSR to every heartbeat until the
+// server signs one.
+func clientTLSSetup() error {
+	if tlsKeyPath == "" {
+		return nil
+	}
+
+	key, err := loadTLSKey(tlsKeyPath)
+	if err != nil {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := saveTLSKey(tlsKeyPath, key); err != nil {
+			return err
+		}
+	}
+
+	tlsLock.Lock()
+	tlsKey = key
+	tlsLock.Unlock()
+
+	if tlsCertPath != "" {
+		if cert, err := os.ReadFile(tlsCertPath); err == nil {
+			tlsLock.Lock()
+			tlsCert = cert
+			tlsLock.Unlock()
+		}
+	}
+
+	return nil
+}
+
+func clientHasCert() bool {
+	tlsLock.Lock()
+	defer tlsLock.Unlock()
+	return tlsCert != nil
+}
+
+// clientCSR returns a PEM-encoded certificate signing request binding this
+// client's key to its CID, so the server can pin the resulting cert's
+// Common Name to the CID it was issued for and reject a heartbeat whose
+// CID doesn't match.
+func clientCSR() ([]byte, error) {
+	tlsLock.Lock()
+	key := tlsKey
+	tlsLock.Unlock()
+
+	if key == nil {
+		return nil, fmt.Errorf("no client key")
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: fmt.Sprintf("%v", CID)},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// clientTLSSignCSR records a cert the server signed for us, persisting it
+// so restarts keep the same identity.
+func clientTLSSignCSR(certPEM []byte) error {
+	if tlsCertPath != "" {
+		if err := os.WriteFile(tlsCertPath, certPEM, 0600); err != nil {
+			return err
+		}
+	}
+
+	tlsLock.Lock()
+	tlsCert = certPEM
+	tlsLock.Unlock()
+
+	log.Info("received signed client cert for CID %v", CID)
+	return nil
+}
+
+// clientTLSConfig builds a tls.Config presenting our pinned identity, once
+// signed, and trusting only the configured CA.
+func clientTLSConfig() (*tls.Config, error) {
+	if tlsCAPath == "" {
+		return nil, fmt.Errorf("no CA configured")
+	}
+
+	caPEM, err := os.ReadFile(tlsCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("invalid CA cert at %v", tlsCAPath)
+	}
+
+	conf := &tls.Config{RootCAs: pool}
+
+	tlsLock.Lock()
+	cert, key := tlsCert, tlsKey
+	tlsLock.Unlock()
+
+	if cert != nil && key != nil {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+		pair, err := tls.X509KeyPair(cert, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+
+	return conf, nil
+}
+
+func loadTLSKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid key file %v", path)
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func saveTLSKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, pemBytes, 0600)
+}
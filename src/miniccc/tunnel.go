@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	log "minilog"
+	"net"
+	"sync"
+)
+
+const tunnelChunkSize = 32 * 1024
+
+type tunnelStream struct {
+	conn net.Conn // only ever touched by tunnelWorker
+	cmds chan *Command
+	quit chan struct{}
+
+	closed bool // guarded by tunnelsLock
+}
+
+var (
+	tunnels     = make(map[int]*tunnelStream)
+	tunnelsLock sync.Mutex
+)
+
+// clientCommandTunnel is the dispatch loop's entry point for COMMAND_TUNNEL.
+// It only does a map lookup/insert and a send on the stream's buffered cmds
+// channel, handing the actual dial and writes off to a per-stream worker
+// goroutine -- so a slow dial or a backed-up write to an unreachable
+// TunnelHost:TunnelPort doesn't stall the shared command queue the way it
+// would if done inline. The send blocks only once 64 commands for the
+// stream are waiting on its worker.
+//
+// cmds is never closed -- only quit is, exactly once, under tunnelsLock --
+// so a send here can never race a close on cmds itself; if the stream is
+// torn down concurrently we just give up on quit instead of panicking.
+func clientCommandTunnel(c *Command) {
+	tunnelsLock.Lock()
+	t, ok := tunnels[c.StreamID]
+	if !ok {
+		t = &tunnelStream{cmds: make(chan *Command, 64), quit: make(chan struct{})}
+		tunnels[c.StreamID] = t
+		go tunnelWorker(c.StreamID, t)
+	}
+	closed := t.closed
+	tunnelsLock.Unlock()
+
+	if closed {
+		return
+	}
+
+	select {
+	case t.cmds <- c:
+	case <-t.quit:
+	}
+}
+
+// tunnelWorker owns one tunnel stream's local connection -- it's the only
+// goroutine that ever touches t.conn -- dialing on the first command for
+// the stream and serializing every write and FIN after that, so commands
+// for a stream are applied in the order they were dispatched, off the
+// shared dispatch loop.
+func tunnelWorker(streamID int, t *tunnelStream) {
+	defer func() {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}()
+
+	for {
+		var c *Command
+		select {
+		case c = <-t.cmds:
+		case <-t.quit:
+			return
+		}
+
+		if t.conn == nil {
+			conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", c.TunnelHost, c.TunnelPort))
+			if err != nil {
+				queueResponse(&Response{ID: c.ID, StreamID: streamID, Stderr: err.Error(), FIN: true})
+				removeTunnelStream(streamID, t)
+				return
+			}
+
+			t.conn = conn
+			go tunnelReadLoop(c.ID, streamID, t)
+		}
+
+		if len(c.Data) > 0 {
+			if _, err := t.conn.Write(c.Data); err != nil {
+				log.Error("tunnel %v write: %v", streamID, err)
+				removeTunnelStream(streamID, t)
+				return
+			}
+		}
+
+		if c.FIN {
+			if tc, ok := t.conn.(*net.TCPConn); ok {
+				tc.CloseWrite()
+			}
+		}
+	}
+}
+
+// tunnelReadLoop relays bytes read from the local service back to the
+// server as a stream of Responses tagged with the tunnel's StreamID, until
+// the local connection's read side is done. t.conn is never reassigned
+// after this goroutine is started, so reading it here needs no lock.
+func tunnelReadLoop(id, streamID int, t *tunnelStream) {
+	buf := make([]byte, tunnelChunkSize)
+	for {
+		n, err := t.conn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			queueResponse(&Response{ID: id, StreamID: streamID, Data: data})
+		}
+		if err != nil {
+			queueResponse(&Response{ID: id, StreamID: streamID, FIN: true})
+			return
+		}
+	}
+}
+
+// removeTunnelStream removes t from tunnels, if it's still the current
+// entry for streamID, and wakes up anything blocked sending to it on
+// quit. tunnelWorker closes t.conn itself once it observes quit, so
+// callers here never touch the connection directly. Safe to call more
+// than once for the same stream.
+func removeTunnelStream(streamID int, t *tunnelStream) {
+	tunnelsLock.Lock()
+	if cur, ok := tunnels[streamID]; ok && cur == t {
+		delete(tunnels, streamID)
+		t.closed = true
+		close(t.quit)
+	}
+	tunnelsLock.Unlock()
+}
+
+// clientCommandTunnelClose fully tears down a tunnel stream and reclaims
+// its StreamID.
+func clientCommandTunnelClose(c *Command) {
+	tunnelsLock.Lock()
+	t, ok := tunnels[c.StreamID]
+	if ok {
+		delete(tunnels, c.StreamID)
+		t.closed = true
+		close(t.quit)
+	}
+	tunnelsLock.Unlock()
+}
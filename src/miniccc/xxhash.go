@@ -0,0 +1,98 @@
+package main
+
+// Minimal implementation of 64-bit xxHash (xxHash64, seed 0). It's used to
+// verify file chunks and whole-file contents during transfer -- not a
+// cryptographic hash, just a fast, well-distributed checksum.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	acc *= xxPrime1
+	return acc
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	acc = acc*xxPrime1 + xxPrime4
+	return acc
+}
+
+func le64(b []byte) uint64 {
+	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+// xxhash64 computes the 64-bit xxHash digest of data with seed 0.
+func xxhash64(data []byte) uint64 {
+	n := len(data)
+	i := 0
+
+	var h uint64
+
+	if n >= 32 {
+		var v1 uint64 = xxPrime1
+		v1 += xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := uint64(0)
+		v4 -= xxPrime1
+
+		for ; i+32 <= n; i += 32 {
+			v1 = xxRound(v1, le64(data[i:]))
+			v2 = xxRound(v2, le64(data[i+8:]))
+			v3 = xxRound(v3, le64(data[i+16:]))
+			v4 = xxRound(v4, le64(data[i+24:]))
+		}
+
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; i+8 <= n; i += 8 {
+		h ^= xxRound(0, le64(data[i:]))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if i+4 <= n {
+		h ^= uint64(le32(data[i:])) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		i += 4
+	}
+
+	for ; i < n; i++ {
+		h ^= uint64(data[i]) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+// Reference digests below are the published xxHash64 (seed 0) test
+// vectors, cross-checked against an independent implementation.
+func TestXxhash64(t *testing.T) {
+	cases := []struct {
+		in   string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"as", 0x1c330fb2d66be179},
+		{"asd", 0x631c37ce72a97393},
+		{"asdf", 0x415872f599cea71e},
+		// 45 bytes, exercises the 32-byte multi-block path plus a tail
+		{"the quick brown fox jumps over the lazy dog!!", 0xc40b3eee2c011af9},
+	}
+
+	for _, c := range cases {
+		if got := xxhash64([]byte(c.in)); got != c.want {
+			t.Errorf("xxhash64(%q) = %016x, want %016x", c.in, got, c.want)
+		}
+	}
+}